@@ -23,14 +23,48 @@ import (
 	"go.uber.org/zap"
 	"go4.org/netipx"
 	"golang.org/x/sys/unix"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
 	"github.com/siderolabs/talemu/internal/pkg/machine/network/watch"
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/wireguard"
 )
 
 // LinkSpecController applies network.LinkSpec to the actual interfaces.
-type LinkSpecController struct{}
+//
+// The WireGuard backend is configurable per controller (i.e. per emulated machine), so
+// that a kernel-backed machine and a fully userspace one can coexist on the same host. If
+// Backend is set, it's used as-is; otherwise Run creates one itself, picking Kernel or
+// Userspace according to Mode.
+type LinkSpecController struct {
+	Backend wireguard.Backend
+
+	// Mode selects the Backend implementation Run creates when Backend is nil. Defaults
+	// to wireguard.BackendModeKernel, matching a real Talos machine.
+	Mode wireguard.BackendMode
+
+	// TunMode is forwarded to wireguard.NewUserspace when Mode is
+	// wireguard.BackendModeUserspace; it's ignored otherwise.
+	TunMode wireguard.TunMode
+
+	// Filters resolves the filter chain a link's FilterRef names, for links whose backend
+	// supports packet filtering (currently only a Userspace wireguard.Backend). Left nil,
+	// no link ever gets a filter installed. policy.Controller is the resource-backed
+	// implementation: it compiles policy.NetworkPolicySpec resources into filter.Func and
+	// resolves a FilterRef by looking up the resource it names.
+	//
+	// network.LinkSpec itself has no FilterRef field yet, so until upstream gains one,
+	// FilterRefs carries the same information keyed by link name, naming a
+	// policy.NetworkPolicySpec resource by ID.
+	Filters    FilterResolver
+	FilterRefs map[string]string
+}
+
+// FilterResolver looks up the packet filter chain a FilterRef names. policy.Controller is
+// the resource-backed implementation.
+type FilterResolver interface {
+	Filter(filterRef string) (filter.Func, bool)
+}
 
 // Name implements controller.Controller interface.
 func (ctrl *LinkSpecController) Name() string {
@@ -75,11 +109,19 @@ func (ctrl *LinkSpecController) Run(ctx context.Context, r controller.Runtime, l
 
 	defer conn.Close() //nolint:errcheck
 
-	wgClient, err := wgctrl.New()
-	if err != nil {
-		logger.Warn("error creating wireguard client", zap.Error(err))
-	} else {
-		defer wgClient.Close() //nolint:errcheck
+	backend := ctrl.Backend
+	if backend == nil {
+		if ctrl.Mode == wireguard.BackendModeUserspace {
+			backend = wireguard.NewUserspace(ctrl.TunMode, logger)
+		} else if backend, err = wireguard.NewKernel(conn); err != nil {
+			logger.Warn("error creating wireguard backend", zap.Error(err))
+		}
+	}
+
+	backend = wrapLazy(backend)
+
+	if backend != nil {
+		defer backend.Close() //nolint:errcheck
 	}
 
 	for {
@@ -118,7 +160,7 @@ func (ctrl *LinkSpecController) Run(ctx context.Context, r controller.Runtime, l
 		for _, res := range list.Items {
 			link := res.(*network.LinkSpec) //nolint:forcetypeassert,errcheck
 
-			if err = ctrl.syncLink(ctx, r, logger, conn, wgClient, &links, link); err != nil {
+			if err = ctrl.syncLink(ctx, r, logger, conn, backend, &links, link); err != nil {
 				multiErr = multierror.Append(multiErr, err)
 			}
 		}
@@ -131,6 +173,53 @@ func (ctrl *LinkSpecController) Run(ctx context.Context, r controller.Runtime, l
 	}
 }
 
+// wrapLazy wraps backend in wireguard.NewLazy, if, and only if, doing so can actually pay
+// off: Lazy only ever materializes a pending peer via the Userspace send path's observer
+// hook (see wireguard.NewLazy), so wrapping a Kernel backend (or anything else that doesn't
+// expose that hook) would strand its peers in the shadow set forever, never reaching the
+// real device.
+func wrapLazy(backend wireguard.Backend) wireguard.Backend {
+	if _, ok := backend.(*wireguard.Userspace); !ok {
+		return backend
+	}
+
+	// peers are only materialized into the backend once they're actually active, so an
+	// emulated fleet with a large full-mesh peer set doesn't pay for every peer up front.
+	return wireguard.NewLazy(backend, wireguard.DefaultIdleTimeout)
+}
+
+// filterSetter is implemented by wireguard.Backend implementations which support
+// installing a packet filter chain on a link (currently only wireguard.Userspace, directly
+// or through wireguard.Lazy).
+type filterSetter interface {
+	SetFilter(name string, fn filter.Func) bool
+}
+
+// syncFilter installs the filter chain configured for name, if any, on a best-effort
+// basis: backends that don't support filtering (e.g. a kernel link) and links with no
+// FilterRef configured are silently left alone.
+func (ctrl *LinkSpecController) syncFilter(backend wireguard.Backend, name string, logger *zap.Logger) {
+	if ctrl.Filters == nil {
+		return
+	}
+
+	ref, ok := ctrl.FilterRefs[name]
+	if !ok {
+		return
+	}
+
+	fn, ok := ctrl.Filters.Filter(ref)
+	if !ok {
+		logger.Warn("filter ref not found", zap.String("filter_ref", ref))
+
+		return
+	}
+
+	if fs, ok := backend.(filterSetter); ok {
+		fs.SetFilter(name, fn)
+	}
+}
+
 // FindLink looks up the link in the list of the links from rtnetlink.
 func FindLink(links []rtnetlink.LinkMessage, name string) *rtnetlink.LinkMessage {
 	index := slices.IndexFunc(links, func(link rtnetlink.LinkMessage) bool {
@@ -166,8 +255,12 @@ func FindLink(links []rtnetlink.LinkMessage, name string) *rtnetlink.LinkMessage
 //
 // For wireguard links, only settings are synced with the diff generated by the WireguardSpec.
 //
+// Bridge, dummy and veth links need no further settings sync once created: a bridge and a
+// dummy interface come up with sane kernel defaults, and a veth pair is fully described by
+// its two names, both supplied at creation time.
+//
 //nolint:gocyclo,cyclop,gocognit,maintidx
-func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runtime, logger *zap.Logger, conn *rtnetlink.Conn, wgClient *wgctrl.Client,
+func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runtime, logger *zap.Logger, conn *rtnetlink.Conn, backend wireguard.Backend,
 	links *[]rtnetlink.LinkMessage, link *network.LinkSpec,
 ) error {
 	logger = logger.With(zap.String("link", link.TypedSpec().Name))
@@ -192,6 +285,14 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 				if err != nil {
 					return fmt.Errorf("error listing links: %w", err)
 				}
+			} else if link.TypedSpec().Kind == network.LinkKindWireguard && backend != nil {
+				// the backend might be managing a link with no kernel-visible counterpart
+				// (e.g. Userspace), so give it a chance to tear it down too.
+				if err := backend.Delete(link.TypedSpec().Name); err != nil {
+					return fmt.Errorf("error deleting wireguard link %q: %w", link.TypedSpec().Name, err)
+				}
+
+				logger.Info("deleted link")
 			}
 		}
 
@@ -204,8 +305,6 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 
 		// check if type/kind matches for the existing logical link
 		if existing != nil && link.TypedSpec().Logical {
-			replace := false
-
 			if existing.Attributes.Info == nil {
 				logger.Warn("requested logical link has no info, skipping sync",
 					zap.String("name", existing.Attributes.Name),
@@ -216,8 +315,9 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 				return nil
 			}
 
-			// if type/kind doesn't match, recreate the link to change it
-			if existing.Type != uint16(link.TypedSpec().Type) || existing.Attributes.Info.Kind != link.TypedSpec().Kind {
+			// recreate the link if its kind/type changed (e.g. bond -> wireguard), or, for
+			// a VLAN link, if settings the kernel refuses to change on a live link did
+			if shouldReplaceLink(existing, link) {
 				logger.Info("replacing logical link",
 					zap.String("old_kind", existing.Attributes.Info.Kind),
 					zap.String("new_kind", link.TypedSpec().Kind),
@@ -225,10 +325,6 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 					zap.Stringer("new_type", link.TypedSpec().Type),
 				)
 
-				replace = true
-			}
-
-			if replace {
 				if err := conn.Link.Delete(existing.Index); err != nil {
 					return fmt.Errorf("error deleting link %q: %w", link.TypedSpec().Name, err)
 				}
@@ -245,53 +341,65 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 				return nil
 			}
 
-			// create logical interface
-			var (
-				parentIndex uint32
-				data        []byte
-				err         error
-			)
+			if link.TypedSpec().Kind == network.LinkKindWireguard {
+				if backend == nil {
+					return fmt.Errorf("wireguard backend not available, cannot create wireguard link %q", link.TypedSpec().Name)
+				}
 
-			// skip any kinds of network interfaces except wireguard
-			if link.TypedSpec().Kind != network.LinkKindWireguard {
-				return nil
-			}
+				if err := backend.Create(link.TypedSpec().Name); err != nil {
+					return fmt.Errorf("error creating wireguard link %q: %w", link.TypedSpec().Name, err)
+				}
+			} else {
+				data, parentIndex, err := encodeLinkData(link, *links)
+				if err != nil {
+					return fmt.Errorf("error encoding link attributes for %q: %w", link.TypedSpec().Name, err)
+				}
 
-			if err = conn.Link.New(&rtnetlink.LinkMessage{
-				Type: uint16(link.TypedSpec().Type),
-				Attributes: &rtnetlink.LinkAttributes{
-					Name: link.TypedSpec().Name,
-					Type: parentIndex,
-					Info: &rtnetlink.LinkInfo{
-						Kind: link.TypedSpec().Kind,
-						Data: data,
+				if err = conn.Link.New(&rtnetlink.LinkMessage{
+					Type: uint16(link.TypedSpec().Type),
+					Attributes: &rtnetlink.LinkAttributes{
+						Name: link.TypedSpec().Name,
+						Type: parentIndex,
+						Info: &rtnetlink.LinkInfo{
+							Kind: link.TypedSpec().Kind,
+							Data: data,
+						},
 					},
-				},
-			}); err != nil {
-				return fmt.Errorf("error creating logical link %q: %w", link.TypedSpec().Name, err)
+				}); err != nil {
+					return fmt.Errorf("error creating logical link %q: %w", link.TypedSpec().Name, err)
+				}
 			}
 
 			logger.Info("created new link", zap.String("kind", link.TypedSpec().Kind))
 
-			// refresh links as the link list got changed
+			// refresh links as the link list got changed (for wireguard, in case the
+			// backend created a real kernel interface, e.g. the Kernel backend; existing
+			// stays nil for backends which don't expose one to rtnetlink, e.g. Userspace,
+			// in which case the UP/MTU sync below is skipped, as there's no kernel link to
+			// apply those to)
+			var err error
+
 			*links, err = conn.Link.List()
 			if err != nil {
 				return fmt.Errorf("error listing links: %w", err)
 			}
 
 			existing = FindLink(*links, link.TypedSpec().Name)
-			if existing == nil {
+
+			if existing == nil && link.TypedSpec().Kind != network.LinkKindWireguard {
 				return fmt.Errorf("created link %q not found in the link list", link.TypedSpec().Name)
 			}
 		}
 
 		// sync wireguard settings
 		if link.TypedSpec().Kind == network.LinkKindWireguard {
-			if wgClient == nil {
-				return fmt.Errorf("wireguard client not available, cannot configure wireguard link %q", link.TypedSpec().Name)
+			if backend == nil {
+				return fmt.Errorf("wireguard backend not available, cannot configure wireguard link %q", link.TypedSpec().Name)
 			}
 
-			wgDev, err := wgClient.Device(link.TypedSpec().Name)
+			ctrl.syncFilter(backend, link.TypedSpec().Name, logger)
+
+			wgDev, err := backend.Device(link.TypedSpec().Name)
 			if err != nil {
 				return fmt.Errorf("error getting wireguard settings for %q: %w", link.TypedSpec().Name, err)
 			}
@@ -310,7 +418,7 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 					return fmt.Errorf("error creating wireguard config patch for %q: %w", link.TypedSpec().Name, err)
 				}
 
-				if err = wgClient.ConfigureDevice(link.TypedSpec().Name, *config); err != nil {
+				if err = backend.Configure(link.TypedSpec().Name, config); err != nil {
 					return fmt.Errorf("error configuring wireguard device %q: %w", link.TypedSpec().Name, err)
 				}
 
@@ -327,6 +435,26 @@ func (ctrl *LinkSpecController) syncLink(ctx context.Context, r controller.Runti
 			}
 		}
 
+		if existing == nil {
+			// the link has no kernel-visible counterpart (e.g. a Userspace wireguard
+			// backend), so there's no rtnetlink state left to sync.
+			return nil
+		}
+
+		// enslave this link to its bond master, if it's configured to be a bond slave
+		// (commonly a physical NIC, but can be any link, e.g. a veth end)
+		if err := ctrl.syncBondSlave(conn, logger, *links, link, existing); err != nil {
+			return err
+		}
+
+		// re-apply bond master settings, bouncing the bond if some of them can't be
+		// changed while it's up or has slaves enslaved
+		if link.TypedSpec().Kind == network.LinkKindBond {
+			if err := ctrl.syncBondMaster(conn, logger, *links, link, existing); err != nil {
+				return err
+			}
+		}
+
 		// sync UP flag
 		existingUp := existing.Flags&unix.IFF_UP == unix.IFF_UP
 		if existingUp != link.TypedSpec().Up {
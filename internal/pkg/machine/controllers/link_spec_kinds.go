@@ -0,0 +1,318 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/siderolabs/talos/pkg/machinery/resources/network"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// ifla VLAN attribute constants, as defined by <linux/if_link.h>.
+const (
+	iflaVlanID       = 1
+	iflaVlanProtocol = 5
+)
+
+// ifla bond attribute constants, as defined by <linux/if_link.h>.
+const iflaBondMode = 1
+
+// iflaVethInfoPeer and iflaIfname are, respectively, IFLA_VETH_INFO_PEER and IFLA_IFNAME,
+// as defined by <linux/if_link.h>: a veth's Data carries a single nested attribute holding
+// the peer's own link attributes (here, just its name).
+const (
+	iflaVethInfoPeer = 1
+	iflaIfname       = 3
+)
+
+// encodeLinkData builds the kind-specific rtnetlink.LinkInfo.Data for a logical link, and
+// resolves the parent link index for kinds that need one (currently only VLAN).
+//
+// Bridge and dummy links need no kind-specific attributes to come up with sane defaults,
+// so they return a nil Data. veth is handled separately by encodeVethData, since it needs
+// to embed the peer's name rather than a handful of scalar attributes.
+func encodeLinkData(link *network.LinkSpec, links []rtnetlink.LinkMessage) (data []byte, parentIndex uint32, err error) {
+	switch link.TypedSpec().Kind {
+	case network.LinkKindVLAN:
+		parent := FindLink(links, link.TypedSpec().ParentName)
+		if parent == nil {
+			return nil, 0, fmt.Errorf("vlan parent link %q not found", link.TypedSpec().ParentName)
+		}
+
+		protocol := make([]byte, 2)
+		binary.BigEndian.PutUint16(protocol, uint16(link.TypedSpec().VLAN.Protocol))
+
+		ae := netlink.NewAttributeEncoder()
+		ae.Uint16(iflaVlanID, link.TypedSpec().VLAN.VID)
+		// IFLA_VLAN_PROTOCOL is a __be16: network (big-endian) byte order, unlike most
+		// other netlink attributes.
+		ae.Bytes(iflaVlanProtocol, protocol)
+
+		data, err = ae.Encode()
+		if err != nil {
+			return nil, 0, fmt.Errorf("error encoding vlan attributes: %w", err)
+		}
+
+		return data, parent.Index, nil
+	case network.LinkKindBond:
+		ae := netlink.NewAttributeEncoder()
+		ae.Uint8(iflaBondMode, uint8(link.TypedSpec().BondMaster.Mode))
+
+		data, err = ae.Encode()
+		if err != nil {
+			return nil, 0, fmt.Errorf("error encoding bond attributes: %w", err)
+		}
+
+		return data, 0, nil
+	case network.LinkKindVEth:
+		data, err = encodeVethData(link.TypedSpec().ParentName)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return data, 0, nil
+	default:
+		// bridge, dummy: no kind-specific attributes required to create the link
+		return nil, 0, nil
+	}
+}
+
+// ifinfomsgSize is sizeof(struct ifinfomsg) from <linux/rtnetlink.h>: family (1 byte), pad
+// (1 byte), type (2 bytes), index (4 bytes), flags (4 bytes), change (4 bytes).
+const ifinfomsgSize = 16
+
+// encodeVethData builds the Data for a veth link, embedding the peer interface's name.
+//
+// Talemu reuses LinkSpec.ParentName (otherwise only meaningful for VLAN links) to carry
+// the peer name for veth links, so that emulated machines can be wired to each other or to
+// host bridges without introducing a veth-specific field.
+func encodeVethData(peerName string) ([]byte, error) {
+	peerAE := netlink.NewAttributeEncoder()
+	peerAE.String(iflaIfname, peerName)
+
+	peerAttrs, err := peerAE.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding veth peer attributes: %w", err)
+	}
+
+	// the kernel's veth_newlink parses IFLA_VETH_INFO_PEER as a struct ifinfomsg followed
+	// by its own attributes, not a bare attribute list; an all-zero ifinfomsg (family
+	// AF_UNSPEC, no index/flags) is what a peer described only by name needs.
+	peerInfo := make([]byte, ifinfomsgSize+len(peerAttrs))
+	copy(peerInfo[ifinfomsgSize:], peerAttrs)
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(iflaVethInfoPeer, peerInfo)
+
+	return ae.Encode()
+}
+
+// decodeUint8Attr extracts a single uint8 attribute of the given type out of a
+// rtnetlink.LinkInfo.Data blob, as produced by netlink.AttributeDecoder.
+func decodeUint8Attr(data []byte, attrType uint16) (uint8, bool) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return 0, false
+	}
+
+	for ad.Next() {
+		if ad.Type() == attrType {
+			return ad.Uint8(), ad.Err() == nil
+		}
+	}
+
+	return 0, false
+}
+
+// decodeUint16Attr extracts a single (host-byte-order) uint16 attribute of the given type
+// out of a rtnetlink.LinkInfo.Data blob.
+func decodeUint16Attr(data []byte, attrType uint16) (uint16, bool) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return 0, false
+	}
+
+	for ad.Next() {
+		if ad.Type() == attrType {
+			return ad.Uint16(), ad.Err() == nil
+		}
+	}
+
+	return 0, false
+}
+
+// decodeBigEndianUint16Attr extracts a single network-byte-order (__be16) uint16 attribute
+// of the given type out of a rtnetlink.LinkInfo.Data blob.
+func decodeBigEndianUint16Attr(data []byte, attrType uint16) (uint16, bool) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return 0, false
+	}
+
+	for ad.Next() {
+		if ad.Type() == attrType {
+			b := ad.Bytes()
+			if ad.Err() != nil || len(b) != 2 {
+				return 0, false
+			}
+
+			return binary.BigEndian.Uint16(b), true
+		}
+	}
+
+	return 0, false
+}
+
+// vlanSettingsChanged reports whether existing's VID or protocol differ from what link
+// wants, by decoding just those two attributes out of the kernel's full IFLA_INFO_DATA
+// dump. Unlike the minimal Data encodeLinkData produces for creation, that dump carries
+// several attributes we never set, so comparing it byte-for-byte against our encoding would
+// (almost) always report a change.
+func vlanSettingsChanged(existing *rtnetlink.LinkMessage, link *network.LinkSpec) bool {
+	if existing.Attributes.Info == nil {
+		return true
+	}
+
+	vid, ok := decodeUint16Attr(existing.Attributes.Info.Data, iflaVlanID)
+	if !ok || vid != link.TypedSpec().VLAN.VID {
+		return true
+	}
+
+	protocol, ok := decodeBigEndianUint16Attr(existing.Attributes.Info.Data, iflaVlanProtocol)
+	if !ok || protocol != uint16(link.TypedSpec().VLAN.Protocol) {
+		return true
+	}
+
+	return false
+}
+
+// shouldReplaceLink reports whether existing must be deleted and recreated to bring it in
+// line with link: either its kind or type changed (e.g. a bond becoming a wireguard link),
+// or, for a VLAN link, settings that the kernel refuses to change on a live link did.
+func shouldReplaceLink(existing *rtnetlink.LinkMessage, link *network.LinkSpec) bool {
+	if existing.Attributes.Info.Kind != link.TypedSpec().Kind || existing.Type != uint16(link.TypedSpec().Type) {
+		return true
+	}
+
+	return link.TypedSpec().Kind == network.LinkKindVLAN && vlanSettingsChanged(existing, link)
+}
+
+// syncBondSlave enslaves link to its configured bond master, if any, by setting the
+// link's IFLA_MASTER attribute to the master's ifindex.
+//
+// This runs for every link, logical or physical, since a bond slave is commonly a
+// physical NIC (or, in emulation, a veth end standing in for one).
+func (ctrl *LinkSpecController) syncBondSlave(
+	conn *rtnetlink.Conn, logger *zap.Logger, links []rtnetlink.LinkMessage, link *network.LinkSpec, existing *rtnetlink.LinkMessage,
+) error {
+	masterName := link.TypedSpec().BondSlave.MasterName
+	if masterName == "" {
+		return nil
+	}
+
+	master := FindLink(links, masterName)
+	if master == nil {
+		return fmt.Errorf("bond master link %q not found for slave %q", masterName, link.TypedSpec().Name)
+	}
+
+	if existing.Attributes.Master == master.Index {
+		// already enslaved
+		return nil
+	}
+
+	if err := conn.Link.Set(&rtnetlink.LinkMessage{
+		Family: existing.Family,
+		Type:   existing.Type,
+		Index:  existing.Index,
+		Attributes: &rtnetlink.LinkAttributes{
+			Master: master.Index,
+		},
+	}); err != nil {
+		return fmt.Errorf("error enslaving %q to bond %q: %w", link.TypedSpec().Name, masterName, err)
+	}
+
+	logger.Info("enslaved link to bond", zap.String("master", masterName))
+
+	return nil
+}
+
+// syncBondMaster re-applies bond master settings that the kernel refuses to change while
+// the bond is administratively up or still has slaves enslaved: it brings the bond down
+// and un-enslaves its current slaves first, relying on the next reconcile cycle (driven by
+// the link watcher) to bring it back up and re-enslave, now with the new settings applied.
+func (ctrl *LinkSpecController) syncBondMaster(
+	conn *rtnetlink.Conn, logger *zap.Logger, links []rtnetlink.LinkMessage, link *network.LinkSpec, existing *rtnetlink.LinkMessage,
+) error {
+	desiredMode := uint8(link.TypedSpec().BondMaster.Mode)
+
+	if existing.Attributes.Info != nil {
+		if mode, ok := decodeUint8Attr(existing.Attributes.Info.Data, iflaBondMode); ok && mode == desiredMode {
+			// already matches: comparing the kernel's full attribute dump against our
+			// freshly (and minimally) encoded Data via bytes.Equal would never match, since
+			// the kernel reports several attributes we never set, bouncing the bond every
+			// cycle
+			return nil
+		}
+	}
+
+	data, _, err := encodeLinkData(link, links)
+	if err != nil {
+		return fmt.Errorf("error encoding bond settings for %q: %w", link.TypedSpec().Name, err)
+	}
+
+	wasUp := existing.Flags&unix.IFF_UP == unix.IFF_UP
+
+	if wasUp {
+		if err = conn.Link.Set(&rtnetlink.LinkMessage{
+			Family: existing.Family,
+			Type:   existing.Type,
+			Index:  existing.Index,
+			Flags:  0,
+			Change: unix.IFF_UP,
+		}); err != nil {
+			return fmt.Errorf("error bringing bond %q down: %w", link.TypedSpec().Name, err)
+		}
+	}
+
+	for _, candidate := range links {
+		if candidate.Attributes == nil || candidate.Attributes.Master != existing.Index {
+			continue
+		}
+
+		if err = conn.Link.Set(&rtnetlink.LinkMessage{
+			Family: candidate.Family,
+			Type:   candidate.Type,
+			Index:  candidate.Index,
+			Attributes: &rtnetlink.LinkAttributes{
+				Master: 0,
+			},
+		}); err != nil {
+			return fmt.Errorf("error un-enslaving %q from bond %q: %w", candidate.Attributes.Name, link.TypedSpec().Name, err)
+		}
+	}
+
+	if err = conn.Link.Set(&rtnetlink.LinkMessage{
+		Family: existing.Family,
+		Type:   existing.Type,
+		Index:  existing.Index,
+		Attributes: &rtnetlink.LinkAttributes{
+			Info: &rtnetlink.LinkInfo{
+				Kind: link.TypedSpec().Kind,
+				Data: data,
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("error applying bond settings for %q: %w", link.TypedSpec().Name, err)
+	}
+
+	logger.Info("applied bond master settings, slaves will be re-enslaved next cycle", zap.String("link", link.TypedSpec().Name))
+
+	return nil
+}
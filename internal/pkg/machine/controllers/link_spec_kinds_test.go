@@ -0,0 +1,182 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/siderolabs/talos/pkg/machinery/nethelpers"
+	"github.com/siderolabs/talos/pkg/machinery/resources/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bondLink(name string, mode nethelpers.BondMode) *network.LinkSpec {
+	link := network.NewLinkSpec(network.NamespaceName, name)
+	link.TypedSpec().Name = name
+	link.TypedSpec().Logical = true
+	link.TypedSpec().Kind = network.LinkKindBond
+	link.TypedSpec().Type = nethelpers.LinkEther
+	link.TypedSpec().BondMaster.Mode = mode
+
+	return link
+}
+
+func wireguardLink(name string) *network.LinkSpec {
+	link := network.NewLinkSpec(network.NamespaceName, name)
+	link.TypedSpec().Name = name
+	link.TypedSpec().Logical = true
+	link.TypedSpec().Kind = network.LinkKindWireguard
+	link.TypedSpec().Type = nethelpers.LinkNone
+
+	return link
+}
+
+func vlanLink(name, parent string, vid uint16, protocol nethelpers.VLANProtocol) *network.LinkSpec {
+	link := network.NewLinkSpec(network.NamespaceName, name)
+	link.TypedSpec().Name = name
+	link.TypedSpec().Logical = true
+	link.TypedSpec().Kind = network.LinkKindVLAN
+	link.TypedSpec().Type = nethelpers.LinkEther
+	link.TypedSpec().ParentName = parent
+	link.TypedSpec().VLAN.VID = vid
+	link.TypedSpec().VLAN.Protocol = protocol
+
+	return link
+}
+
+// existingLinkFor builds the rtnetlink.LinkMessage a real kernel would report for link,
+// using the same encoder the controller uses to create it, so these tests exercise the
+// exact encode/decode round trip the reconcile loop depends on.
+func existingLinkFor(t *testing.T, link *network.LinkSpec, links []rtnetlink.LinkMessage) *rtnetlink.LinkMessage {
+	t.Helper()
+
+	data, _, err := encodeLinkData(link, links)
+	require.NoError(t, err)
+
+	return &rtnetlink.LinkMessage{
+		Type: uint16(link.TypedSpec().Type),
+		Attributes: &rtnetlink.LinkAttributes{
+			Name: link.TypedSpec().Name,
+			Info: &rtnetlink.LinkInfo{
+				Kind: link.TypedSpec().Kind,
+				Data: data,
+			},
+		},
+	}
+}
+
+func TestShouldReplaceLinkKindTransition(t *testing.T) {
+	// a bond link becoming a wireguard link in the spec must always go through the replace
+	// path, since the kernel has no way to change a link's kind in place
+	existing := existingLinkFor(t, bondLink("link0", nethelpers.BondModeActiveBackup), nil)
+
+	assert.True(t, shouldReplaceLink(existing, wireguardLink("link0")))
+}
+
+func TestShouldReplaceLinkUnchanged(t *testing.T) {
+	// a bond whose settings didn't change must not be replaced
+	link := bondLink("link0", nethelpers.BondModeActiveBackup)
+	existing := existingLinkFor(t, link, nil)
+
+	assert.False(t, shouldReplaceLink(existing, link))
+}
+
+func TestShouldReplaceLinkVLANSettingsChanged(t *testing.T) {
+	links := []rtnetlink.LinkMessage{
+		{
+			Index:      1,
+			Attributes: &rtnetlink.LinkAttributes{Name: "eth0"},
+		},
+	}
+
+	original := vlanLink("link0.10", "eth0", 10, nethelpers.VLANProtocol8021Q)
+	existing := existingLinkFor(t, original, links)
+
+	// unchanged: no replace
+	assert.False(t, shouldReplaceLink(existing, original))
+
+	// VID changed: must replace
+	changedVID := vlanLink("link0.10", "eth0", 20, nethelpers.VLANProtocol8021Q)
+	assert.True(t, shouldReplaceLink(existing, changedVID))
+
+	// protocol changed: must replace
+	changedProtocol := vlanLink("link0.10", "eth0", 10, nethelpers.VLANProtocol8021AD)
+	assert.True(t, shouldReplaceLink(existing, changedProtocol))
+}
+
+func TestEncodeLinkDataVLANProtocolByteOrder(t *testing.T) {
+	links := []rtnetlink.LinkMessage{
+		{
+			Index:      1,
+			Attributes: &rtnetlink.LinkAttributes{Name: "eth0"},
+		},
+	}
+
+	data, parentIndex, err := encodeLinkData(vlanLink("link0.10", "eth0", 10, nethelpers.VLANProtocol8021Q), links)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, parentIndex)
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	require.NoError(t, err)
+
+	var sawProtocol bool
+
+	for ad.Next() {
+		if ad.Type() != iflaVlanProtocol {
+			continue
+		}
+
+		sawProtocol = true
+		// 802.1Q (0x8100) must be encoded big-endian, not as the host-order 0x0081
+		assert.Equal(t, []byte{0x81, 0x00}, ad.Bytes())
+	}
+
+	require.NoError(t, ad.Err())
+	assert.True(t, sawProtocol)
+}
+
+func TestEncodeVethDataIncludesIfinfomsgHeader(t *testing.T) {
+	vethData, err := encodeVethData("peer0")
+	require.NoError(t, err)
+
+	ad, err := netlink.NewAttributeDecoder(vethData)
+	require.NoError(t, err)
+
+	var sawPeer bool
+
+	for ad.Next() {
+		if ad.Type() != iflaVethInfoPeer {
+			continue
+		}
+
+		sawPeer = true
+		peer := ad.Bytes()
+
+		// 16-byte struct ifinfomsg must precede the nested attributes
+		require.Greater(t, len(peer), ifinfomsgSize)
+
+		nameAD, err := netlink.NewAttributeDecoder(peer[ifinfomsgSize:])
+		require.NoError(t, err)
+
+		var sawName bool
+
+		for nameAD.Next() {
+			if nameAD.Type() == iflaIfname {
+				sawName = true
+
+				assert.Equal(t, "peer0", nameAD.String())
+			}
+		}
+
+		require.NoError(t, nameAD.Err())
+		assert.True(t, sawName)
+	}
+
+	require.NoError(t, ad.Err())
+	assert.True(t, sawPeer)
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controllers
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/wireguard"
+)
+
+// fakeKernelBackend stands in for wireguard.Kernel: a backend with no way to learn about
+// outbound traffic, like the one a real Talos machine uses by default. It records every
+// peer it's asked to configure, so a test can tell whether a peer actually reached it.
+type fakeKernelBackend struct {
+	configuredPeers []wgtypes.Key
+}
+
+func (k *fakeKernelBackend) Create(string) error { return nil }
+
+func (k *fakeKernelBackend) Configure(_ string, cfg *wgtypes.Config) error {
+	for _, peer := range cfg.Peers {
+		k.configuredPeers = append(k.configuredPeers, peer.PublicKey)
+	}
+
+	return nil
+}
+
+func (k *fakeKernelBackend) Delete(string) error                    { return nil }
+func (k *fakeKernelBackend) Device(string) (*wgtypes.Device, error) { return &wgtypes.Device{}, nil }
+func (k *fakeKernelBackend) Close() error                           { return nil }
+
+// The tests below check wrapLazy's decision rule and its effect on whether a peer reaches a
+// backend's Configure immediately; they stop short of driving syncLink/Run end to end, since
+// that needs a live rtnetlink connection (see link_spec_kinds_test.go, which sticks to
+// testing the pure logic for the same reason).
+
+func TestWrapLazySkipsNonUserspaceBackend(t *testing.T) {
+	// a Kernel-shaped backend has no send-path observer hook for Lazy to materialize peers
+	// from, so wrapping it would strand peers in the shadow set forever (see wrapLazy).
+	wrapped := wrapLazy(&fakeKernelBackend{})
+
+	_, isLazy := wrapped.(*wireguard.Lazy)
+	assert.False(t, isLazy)
+}
+
+func TestWrapLazyWrapsUserspaceBackend(t *testing.T) {
+	backend := wireguard.NewUserspace(wireguard.TunModeNetstack, zap.NewNop())
+
+	wrapped := wrapLazy(backend)
+
+	_, isLazy := wrapped.(*wireguard.Lazy)
+	assert.True(t, isLazy)
+}
+
+func TestWrapLazyNilBackend(t *testing.T) {
+	assert.Nil(t, wrapLazy(nil))
+}
+
+func TestWrapLazyKernelPeerReachesBackendImmediately(t *testing.T) {
+	// the bug this fixes: wrapping a Kernel-shaped backend in Lazy left newly configured
+	// peers stuck in Lazy's shadow map forever, since Lazy only materializes them via the
+	// Userspace-only send-path observer. wrapLazy must leave such a backend unwrapped, so a
+	// peer configured through it is pushed straight through.
+	backend := &fakeKernelBackend{}
+	peer := wgtypes.PeerConfig{
+		PublicKey:  mustKey(t),
+		AllowedIPs: []net.IPNet{mustIPNet(t, "10.0.0.2/32")},
+	}
+
+	wrapped := wrapLazy(backend)
+
+	require.NoError(t, wrapped.Create("link0"))
+	require.NoError(t, wrapped.Configure("link0", &wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}}))
+
+	assert.Equal(t, []wgtypes.Key{peer.PublicKey}, backend.configuredPeers)
+}
+
+func TestWrapLazyUserspacePeerStaysPendingUntilRequested(t *testing.T) {
+	// contrast with the Kernel case above: a Userspace backend IS meant to stay lazy, so a
+	// newly configured peer must NOT reach the inner device until traffic (or an explicit
+	// RequestPeer) activates it.
+	backend := wireguard.NewUserspace(wireguard.TunModeNetstack, zap.NewNop())
+	wrapped := wrapLazy(backend)
+
+	lazy, ok := wrapped.(*wireguard.Lazy)
+	require.True(t, ok)
+
+	require.NoError(t, wrapped.Create("link0"))
+
+	peer := wgtypes.PeerConfig{
+		PublicKey:  mustKey(t),
+		AllowedIPs: []net.IPNet{mustIPNet(t, "10.0.0.2/32")},
+	}
+
+	require.NoError(t, wrapped.Configure("link0", &wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}}))
+
+	dev, err := wrapped.Device("link0")
+	require.NoError(t, err)
+	require.Len(t, dev.Peers, 1) // reported from the shadow set
+
+	innerDev, err := backend.Device("link0")
+	require.NoError(t, err)
+	assert.Empty(t, innerDev.Peers) // not materialized into the inner device yet
+
+	require.NoError(t, lazy.RequestPeer("link0", peer.PublicKey))
+
+	innerDev, err = backend.Device("link0")
+	require.NoError(t, err)
+	assert.Len(t, innerDev.Peers, 1)
+}
+
+func mustKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+
+	key, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+
+	return key.PublicKey()
+}
+
+func mustIPNet(t *testing.T, cidr string) net.IPNet {
+	t.Helper()
+
+	prefix, err := netip.ParsePrefix(cidr)
+	require.NoError(t, err)
+
+	return net.IPNet{IP: prefix.Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())}
+}
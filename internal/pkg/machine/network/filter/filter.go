@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package filter wraps a tun.Device with a packet filter chain, analogous to Tailscale's
+// tstun, so that tests can drop, delay or reorder packets crossing an emulated machine's
+// link, and inject synthesized frames (ARP replies, ICMP unreachables, etc.) without
+// touching the kernel.
+package filter
+
+import (
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Direction identifies which way a packet is crossing a FilteredLink.
+type Direction int
+
+const (
+	// Outbound is a packet leaving the emulated machine, headed for the network.
+	Outbound Direction = iota
+	// Inbound is a packet arriving from the network, headed for the emulated machine.
+	Inbound
+)
+
+// Action is the disposition a Func assigns to a packet.
+type Action int
+
+const (
+	// ActionAccept lets the packet through, possibly after Verdict.Delay.
+	ActionAccept Action = iota
+	// ActionDrop silently discards the packet.
+	ActionDrop
+)
+
+// Verdict is what a Func decides to do with a packet.
+type Verdict struct {
+	Action Action
+	// Delay, if non-zero, holds the packet back by this long before delivering it.
+	// Combined across packets, this is also how reordering is achieved: two packets
+	// accepted with different delays can be delivered out of their original order.
+	Delay time.Duration
+}
+
+// Accept lets the packet through immediately.
+func Accept() Verdict { return Verdict{Action: ActionAccept} }
+
+// Drop silently discards the packet.
+func Drop() Verdict { return Verdict{Action: ActionDrop} }
+
+// Delayed lets the packet through, but only after d has elapsed.
+func Delayed(d time.Duration) Verdict { return Verdict{Action: ActionAccept, Delay: d} }
+
+// Func decides the fate of a single packet crossing a FilteredLink.
+type Func func(packet []byte, dir Direction) Verdict
+
+// acceptAll is the default filter: every packet is let through immediately.
+func acceptAll([]byte, Direction) Verdict { return Accept() }
+
+// Destination extracts the destination address from an IPv4 or IPv6 packet, so a Func can
+// match it against a policy without reimplementing header parsing.
+func Destination(packet []byte) (netip.Addr, bool) {
+	if len(packet) < 1 {
+		return netip.Addr{}, false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, false
+		}
+
+		return netip.AddrFrom4([4]byte(packet[16:20])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, false
+		}
+
+		return netip.AddrFrom16([16]byte(packet[24:40])), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// Observer is called for every packet passing through Read or Write, alongside (and
+// independently of) the active Func's verdict; packets injected via InjectInbound or
+// InjectOutbound are not passed to it. Unlike Func, it can't drop or delay a
+// packet; it exists purely for side effects that need to see traffic regardless of what the
+// policy filter decides to do with it, e.g. Lazy's on-demand peer materialization.
+type Observer func(packet []byte, dir Direction)
+
+// noopObserver is the default observer: it does nothing.
+func noopObserver([]byte, Direction) {}
+
+// FilteredLink wraps a tun.Device, applying a Func to every packet that crosses it in
+// either direction, and allowing synthesized packets to be injected in either direction.
+//
+// FilteredLink itself implements tun.Device, so it can be used anywhere a plain tun.Device
+// is expected (for instance, handed to golang.zx2c4.com/wireguard/device.NewDevice).
+type FilteredLink struct {
+	inner tun.Device
+
+	mu       sync.RWMutex
+	filter   Func
+	observer Observer
+
+	// pendingRead carries both outbound-injected packets and packets Read accepted with a
+	// delay, so Read can deliver them without the caller needing to know the difference.
+	pendingRead chan []byte
+}
+
+// Wrap returns a FilteredLink around inner. The filter defaults to accepting everything.
+func Wrap(inner tun.Device) *FilteredLink {
+	return &FilteredLink{
+		inner:       inner,
+		filter:      acceptAll,
+		observer:    noopObserver,
+		pendingRead: make(chan []byte, 256),
+	}
+}
+
+// SetFilter installs fn as the active filter, replacing whatever was set before. A nil fn
+// resets the filter to accept everything.
+func (f *FilteredLink) SetFilter(fn Func) {
+	if fn == nil {
+		fn = acceptAll
+	}
+
+	f.mu.Lock()
+	f.filter = fn
+	f.mu.Unlock()
+}
+
+func (f *FilteredLink) currentFilter() Func {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.filter
+}
+
+// SetObserver installs fn to be called for every packet passing through Read or Write,
+// regardless of the active filter's verdict. A nil fn disables observation.
+func (f *FilteredLink) SetObserver(fn Observer) {
+	if fn == nil {
+		fn = noopObserver
+	}
+
+	f.mu.Lock()
+	f.observer = fn
+	f.mu.Unlock()
+}
+
+func (f *FilteredLink) currentObserver() Observer {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.observer
+}
+
+// InjectInbound delivers packet to the emulated machine as if it had just been decrypted
+// off the wire, writing it straight to the inner device and bypassing the WireGuard
+// device's send path entirely. It still passes through the inbound filter, so a test can
+// both synthesize a frame and drop it by returning ActionDrop for it.
+func (f *FilteredLink) InjectInbound(packet []byte) {
+	verdict := f.currentFilter()(packet, Inbound)
+	if verdict.Action == ActionDrop {
+		return
+	}
+
+	if verdict.Delay <= 0 {
+		_, _ = f.inner.Write([][]byte{packet}, 0) //nolint:errcheck
+
+		return
+	}
+
+	time.AfterFunc(verdict.Delay, func() {
+		_, _ = f.inner.Write([][]byte{packet}, 0) //nolint:errcheck
+	})
+}
+
+// InjectOutbound delivers packet to the WireGuard device's send path as if the emulated
+// machine had originated it, queuing it for Read the same way a delayed-accept packet is,
+// bypassing the inner device entirely. It still passes through the outbound filter, so a
+// test can both synthesize a frame and drop it by returning ActionDrop for it.
+func (f *FilteredLink) InjectOutbound(packet []byte) {
+	verdict := f.currentFilter()(packet, Outbound)
+	if verdict.Action == ActionDrop {
+		return
+	}
+
+	if verdict.Delay <= 0 {
+		select {
+		case f.pendingRead <- packet:
+		default:
+			// queue full, drop rather than block the reader that feeds it
+		}
+
+		return
+	}
+
+	time.AfterFunc(verdict.Delay, func() {
+		select {
+		case f.pendingRead <- packet:
+		default:
+		}
+	})
+}
+
+// Read implements tun.Device: packets already queued from the inner device or injected
+// outbound are returned first, then a new read from the inner device is attempted.
+func (f *FilteredLink) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case packet := <-f.pendingRead:
+		n := copy(bufs[0][offset:], packet)
+		sizes[0] = n
+
+		return 1, nil
+	default:
+	}
+
+	n, err := f.inner.Read(bufs, sizes, offset)
+	if err != nil {
+		return n, err
+	}
+
+	accepted := 0
+	observer := f.currentObserver()
+
+	for i := 0; i < n; i++ {
+		packet := bufs[i][offset : offset+sizes[i]]
+
+		// a packet the inner device has to offer here is one the emulated machine itself
+		// is sending out, regardless of what the (possibly unrelated) policy verdict below
+		// decides to do with it.
+		observer(packet, Outbound)
+
+		verdict := f.currentFilter()(packet, Outbound)
+		if verdict.Action == ActionDrop {
+			continue
+		}
+
+		if verdict.Delay > 0 {
+			// hand it to the same delayed path as an injected packet
+			cp := append([]byte(nil), packet...)
+
+			time.AfterFunc(verdict.Delay, func() {
+				select {
+				case f.pendingRead <- cp:
+				default:
+				}
+			})
+
+			continue
+		}
+
+		if accepted != i {
+			copy(bufs[accepted][offset:offset+sizes[i]], packet)
+			sizes[accepted] = sizes[i]
+		}
+
+		accepted++
+	}
+
+	return accepted, nil
+}
+
+// Write implements tun.Device: applies the inbound filter to every packet before
+// forwarding the accepted (and not delayed) ones to the inner device in one call.
+func (f *FilteredLink) Write(bufs [][]byte, offset int) (int, error) {
+	forward := make([][]byte, 0, len(bufs))
+	observer := f.currentObserver()
+
+	for _, buf := range bufs {
+		packet := buf[offset:]
+
+		// a packet delivered here is arriving for the emulated machine, regardless of what
+		// the (possibly unrelated) policy verdict below decides to do with it.
+		observer(packet, Inbound)
+
+		verdict := f.currentFilter()(packet, Inbound)
+		switch {
+		case verdict.Action == ActionDrop:
+			// dropped silently, but still counts as "written" from the caller's
+			// perspective, same as a kernel silently dropping a packet
+		case verdict.Delay > 0:
+			cp := append([]byte(nil), packet...)
+
+			time.AfterFunc(verdict.Delay, func() {
+				_, _ = f.inner.Write([][]byte{cp}, 0) //nolint:errcheck
+			})
+		default:
+			forward = append(forward, buf)
+		}
+	}
+
+	if len(forward) > 0 {
+		if _, err := f.inner.Write(forward, offset); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(bufs), nil
+}
+
+// File implements tun.Device.
+func (f *FilteredLink) File() *os.File { return f.inner.File() }
+
+// MTU implements tun.Device.
+func (f *FilteredLink) MTU() (int, error) { return f.inner.MTU() }
+
+// Name implements tun.Device.
+func (f *FilteredLink) Name() (string, error) { return f.inner.Name() }
+
+// Events implements tun.Device.
+func (f *FilteredLink) Events() <-chan tun.Event { return f.inner.Events() }
+
+// BatchSize implements tun.Device.
+func (f *FilteredLink) BatchSize() int { return f.inner.BatchSize() }
+
+// Close implements tun.Device.
+func (f *FilteredLink) Close() error { return f.inner.Close() }
@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package filter_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/tun"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// fakeTun is a minimal tun.Device backed by an in-memory packet queue, just enough for
+// FilteredLink's Read/Write to exercise.
+type fakeTun struct {
+	toRead  [][]byte
+	written [][]byte
+}
+
+func (f *fakeTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+
+	for n < len(bufs) && len(f.toRead) > 0 {
+		packet := f.toRead[0]
+		f.toRead = f.toRead[1:]
+
+		sizes[n] = copy(bufs[n][offset:], packet)
+		n++
+	}
+
+	return n, nil
+}
+
+func (f *fakeTun) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		f.written = append(f.written, append([]byte(nil), buf[offset:]...))
+	}
+
+	return len(bufs), nil
+}
+
+func (f *fakeTun) File() *os.File           { return nil }
+func (f *fakeTun) MTU() (int, error)        { return 1500, nil }
+func (f *fakeTun) Name() (string, error)    { return "fake0", nil }
+func (f *fakeTun) Events() <-chan tun.Event { return nil }
+func (f *fakeTun) BatchSize() int           { return 1 }
+func (f *fakeTun) Close() error             { return nil }
+
+// minimalIPv4Packet returns just enough of an IPv4 header for Destination to parse; the
+// tests here only care about the Direction a filter observes, not the payload.
+func minimalIPv4Packet() []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45 // version 4, IHL 5
+
+	return packet
+}
+
+func TestFilteredLinkReadSeesOutboundDirection(t *testing.T) {
+	// Read returns packets the emulated machine is sending out to the network, so a filter
+	// must see them as Outbound, not Inbound.
+	inner := &fakeTun{toRead: [][]byte{minimalIPv4Packet()}}
+	link := filter.Wrap(inner)
+
+	var seen filter.Direction
+
+	link.SetFilter(func(_ []byte, dir filter.Direction) filter.Verdict {
+		seen = dir
+
+		return filter.Drop()
+	})
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+
+	n, err := link.Read(bufs, sizes, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n) // dropped, so nothing accepted
+	assert.Equal(t, filter.Outbound, seen)
+}
+
+func TestFilteredLinkWriteSeesInboundDirection(t *testing.T) {
+	// Write delivers packets arriving for the emulated machine, so a filter must see them
+	// as Inbound, not Outbound.
+	inner := &fakeTun{}
+	link := filter.Wrap(inner)
+
+	var seen filter.Direction
+
+	link.SetFilter(func(_ []byte, dir filter.Direction) filter.Verdict {
+		seen = dir
+
+		return filter.Drop()
+	})
+
+	n, err := link.Write([][]byte{minimalIPv4Packet()}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n) // "written" from the caller's perspective even though dropped
+	assert.Empty(t, inner.written)
+	assert.Equal(t, filter.Inbound, seen)
+}
+
+func TestFilteredLinkInjectInboundDeliversToInner(t *testing.T) {
+	// InjectInbound simulates a packet decrypted off the wire: it must reach the inner
+	// device directly, not the WireGuard device's Read (send) path.
+	inner := &fakeTun{}
+	link := filter.Wrap(inner)
+
+	packet := minimalIPv4Packet()
+	link.InjectInbound(packet)
+
+	require.Len(t, inner.written, 1)
+	assert.Equal(t, packet, inner.written[0])
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+
+	n, err := link.Read(bufs, sizes, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n) // nothing queued for Read
+}
+
+func TestFilteredLinkInjectInboundHonorsDrop(t *testing.T) {
+	inner := &fakeTun{}
+	link := filter.Wrap(inner)
+
+	link.SetFilter(func(_ []byte, dir filter.Direction) filter.Verdict {
+		if dir == filter.Inbound {
+			return filter.Drop()
+		}
+
+		return filter.Accept()
+	})
+
+	link.InjectInbound(minimalIPv4Packet())
+
+	assert.Empty(t, inner.written)
+}
+
+func TestFilteredLinkInjectOutboundDeliversToRead(t *testing.T) {
+	// InjectOutbound simulates the emulated machine originating a packet: it must reach
+	// Read (the WireGuard device's send path), not the inner device.
+	inner := &fakeTun{}
+	link := filter.Wrap(inner)
+
+	packet := minimalIPv4Packet()
+	link.InjectOutbound(packet)
+
+	assert.Empty(t, inner.written)
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+
+	n, err := link.Read(bufs, sizes, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	assert.Equal(t, packet, bufs[0][:sizes[0]])
+}
+
+func TestFilteredLinkInjectOutboundHonorsDrop(t *testing.T) {
+	inner := &fakeTun{}
+	link := filter.Wrap(inner)
+
+	link.SetFilter(func(_ []byte, dir filter.Direction) filter.Verdict {
+		if dir == filter.Outbound {
+			return filter.Drop()
+		}
+
+		return filter.Accept()
+	})
+
+	link.InjectOutbound(minimalIPv4Packet())
+
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+
+	n, err := link.Read(bufs, sizes, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import (
+	"net/netip"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// compiledRule is a PolicyRule with its Nets pre-parsed, so Compile's returned filter.Func
+// doesn't reparse CIDRs on every packet.
+type compiledRule struct {
+	direction filter.Direction
+	nets      []netip.Prefix
+	verdict   filter.Action
+}
+
+// Compile turns spec's rules into a filter.Func. Malformed CIDRs are skipped rather than
+// failing the whole chain, so one bad rule doesn't take down a link's entire filter.
+func Compile(spec *NetworkPolicySpecSpec) filter.Func {
+	rules := make([]compiledRule, 0, len(spec.Rules))
+
+	for _, rule := range spec.Rules {
+		compiled := compiledRule{direction: rule.Direction, verdict: rule.Verdict}
+
+		for _, net := range rule.Nets {
+			prefix, err := netip.ParsePrefix(net)
+			if err != nil {
+				continue
+			}
+
+			compiled.nets = append(compiled.nets, prefix)
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	return func(packet []byte, dir filter.Direction) filter.Verdict {
+		dst, ok := filter.Destination(packet)
+		if !ok {
+			return filter.Accept()
+		}
+
+		for _, rule := range rules {
+			if rule.direction != dir {
+				continue
+			}
+
+			for _, prefix := range rule.nets {
+				if prefix.Contains(dst) {
+					return filter.Verdict{Action: rule.verdict}
+				}
+			}
+		}
+
+		return filter.Accept()
+	}
+}
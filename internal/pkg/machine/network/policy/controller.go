@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cosi-project/runtime/pkg/controller"
+	"github.com/cosi-project/runtime/pkg/resource"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// Controller watches NetworkPolicySpec resources and compiles each into a filter.Func,
+// keyed by resource ID. It implements controllers.FilterResolver, so it's what actually
+// ties a link's FilterRef to a filter chain through the resource graph, rather than
+// requiring a caller to hand-wire a map.
+type Controller struct {
+	mu      sync.RWMutex
+	filters map[resource.ID]filter.Func
+}
+
+// NewController creates a Controller with no filters compiled yet.
+func NewController() *Controller {
+	return &Controller{filters: map[resource.ID]filter.Func{}}
+}
+
+// Name implements controller.Controller interface.
+func (ctrl *Controller) Name() string {
+	return "network.NetworkPolicyController"
+}
+
+// Inputs implements controller.Controller interface.
+func (ctrl *Controller) Inputs() []controller.Input {
+	return []controller.Input{
+		{
+			Namespace: NamespaceName,
+			Type:      NetworkPolicySpecType,
+			Kind:      controller.InputWeak,
+		},
+	}
+}
+
+// Outputs implements controller.Controller interface.
+func (ctrl *Controller) Outputs() []controller.Output {
+	return nil
+}
+
+// Run implements controller.Controller interface.
+func (ctrl *Controller) Run(ctx context.Context, r controller.Runtime, logger *zap.Logger) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.EventCh():
+		}
+
+		list, err := r.List(ctx, resource.NewMetadata(NamespaceName, NetworkPolicySpecType, "", resource.VersionUndefined))
+		if err != nil {
+			return fmt.Errorf("error listing network policies: %w", err)
+		}
+
+		compiled := make(map[resource.ID]filter.Func, len(list.Items))
+
+		for _, res := range list.Items {
+			spec := res.(*NetworkPolicySpec) //nolint:forcetypeassert,errcheck
+
+			compiled[res.Metadata().ID()] = Compile(spec.TypedSpec())
+		}
+
+		ctrl.mu.Lock()
+		ctrl.filters = compiled
+		ctrl.mu.Unlock()
+
+		logger.Debug("recompiled network policies", zap.Int("count", len(compiled)))
+
+		r.ResetRestartBackoff()
+	}
+}
+
+// Filter implements controllers.FilterResolver: it looks up the filter chain compiled for
+// the NetworkPolicySpec resource named filterRef.
+func (ctrl *Controller) Filter(filterRef string) (filter.Func, bool) {
+	ctrl.mu.RLock()
+	defer ctrl.mu.RUnlock()
+
+	fn, ok := ctrl.filters[resource.ID(filterRef)]
+
+	return fn, ok
+}
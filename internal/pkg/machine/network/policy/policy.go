@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package policy defines NetworkPolicySpec, a local stand-in for the FilterRef target the
+// request asked for on network.LinkSpec: until that field lands upstream, a link's
+// controllers.LinkSpecController.FilterRefs entry names one of these resources by ID, and
+// Controller (see controller.go) resolves it into a compiled filter.Func.
+package policy
+
+import (
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/meta"
+	"github.com/cosi-project/runtime/pkg/resource/typed"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// NamespaceName is the namespace NetworkPolicySpec resources live in.
+const NamespaceName resource.Namespace = "talemu-network"
+
+// NetworkPolicySpecType is the type of the NetworkPolicySpec resource.
+const NetworkPolicySpecType = resource.Type("NetworkPolicySpecs.network.talemu.siderolabs.io")
+
+// NetworkPolicySpec describes a packet filter chain that a link's FilterRef can name.
+type NetworkPolicySpec = typed.Resource[NetworkPolicySpecSpec, NetworkPolicySpecExtension]
+
+// NetworkPolicySpecSpec is an ordered list of rules, evaluated first-match-wins; a packet
+// matched by nothing is accepted.
+type NetworkPolicySpecSpec struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule assigns Verdict to every packet crossing a link in Direction whose destination
+// falls within one of Nets.
+type PolicyRule struct {
+	Direction filter.Direction `yaml:"direction"`
+	Nets      []string         `yaml:"nets"`
+	Verdict   filter.Action    `yaml:"verdict"`
+}
+
+// NewNetworkPolicySpec creates a new NetworkPolicySpec resource.
+func NewNetworkPolicySpec(id resource.ID) *NetworkPolicySpec {
+	return typed.NewResource[NetworkPolicySpecSpec, NetworkPolicySpecExtension](
+		resource.NewMetadata(NamespaceName, NetworkPolicySpecType, id, resource.VersionUndefined),
+		NetworkPolicySpecSpec{},
+	)
+}
+
+// NetworkPolicySpecExtension provides auxiliary methods for NetworkPolicySpec.
+type NetworkPolicySpecExtension struct{}
+
+// ResourceDefinition implements typed.Extension.
+func (NetworkPolicySpecExtension) ResourceDefinition() meta.ResourceDefinitionSpec {
+	return meta.ResourceDefinitionSpec{
+		Type:             NetworkPolicySpecType,
+		DefaultNamespace: NamespaceName,
+	}
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package wireguard provides pluggable backends for bringing up and configuring
+// WireGuard links.
+//
+// The kernel-backed implementation (Kernel) is what a real Talos machine uses, but it
+// requires CAP_NET_ADMIN and a kernel with the wireguard module loaded, which is a hard
+// requirement to drop when emulating a large fleet of machines on a single host or inside
+// an unprivileged container. The userspace implementation (Userspace) instead runs the
+// WireGuard protocol entirely in the emulator process, so many emulated machines can share
+// a host without a kernel wireguard module, and, with TunModeNetstack, without any special
+// privileges.
+package wireguard
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// BackendMode selects which Backend implementation a LinkSpecController should create for
+// links it manages, when it isn't handed a pre-built Backend directly.
+type BackendMode int
+
+const (
+	// BackendModeKernel creates a Kernel backend, bringing up real kernel WireGuard
+	// interfaces. This is the default, matching a real Talos machine.
+	BackendModeKernel BackendMode = iota
+
+	// BackendModeUserspace creates a Userspace backend, so the emulated machine needs no
+	// kernel wireguard module, and, with TunModeNetstack, no elevated privileges.
+	BackendModeUserspace
+)
+
+// Backend abstracts over the mechanism used to bring up and configure a WireGuard link.
+//
+// A Backend is owned by a single emulated machine: each emulated machine picks (and keeps
+// for its lifetime) the backend implementation that suits the environment it runs in, so
+// a kernel-backed machine and a userspace one can coexist on the same host.
+type Backend interface {
+	// Create brings a new WireGuard interface called name into existence.
+	//
+	// Create is a no-op if the interface already exists.
+	Create(name string) error
+
+	// Configure applies a wgtypes.Config diff, as produced by wireguardSpec.Encode, to the
+	// named interface.
+	Configure(name string, cfg *wgtypes.Config) error
+
+	// Delete removes the named interface.
+	Delete(name string) error
+
+	// Device returns the current state of the named interface, in the same shape as
+	// wgctrl.Client.Device, so that the reconcile loop can diff against it regardless of
+	// which backend produced it.
+	Device(name string) (*wgtypes.Device, error)
+
+	// Close releases any resources held by the backend.
+	Close() error
+}
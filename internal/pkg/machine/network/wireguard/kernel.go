@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wireguard
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/siderolabs/talos/pkg/machinery/resources/network"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// NewKernel creates a Backend which creates real kernel WireGuard interfaces over
+// rtnetlink and configures them via wgctrl (netlink `genl` WireGuard API).
+//
+// This is the backend a real Talos machine uses, and it requires CAP_NET_ADMIN plus a
+// kernel with the wireguard module loaded.
+func NewKernel(conn *rtnetlink.Conn) (Backend, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("error creating wireguard client: %w", err)
+	}
+
+	return &Kernel{
+		conn:   conn,
+		client: client,
+	}, nil
+}
+
+// Kernel is a Backend backed by a real kernel WireGuard interface.
+type Kernel struct {
+	conn   *rtnetlink.Conn
+	client *wgctrl.Client
+}
+
+// Create implements Backend.
+func (k *Kernel) Create(name string) error {
+	links, err := k.conn.Link.List()
+	if err != nil {
+		return fmt.Errorf("error listing links: %w", err)
+	}
+
+	for _, link := range links {
+		if link.Attributes != nil && link.Attributes.Name == name {
+			// already exists, same as the other backends' Create
+			return nil
+		}
+	}
+
+	if err := k.conn.Link.New(&rtnetlink.LinkMessage{
+		Attributes: &rtnetlink.LinkAttributes{
+			Name: name,
+			Info: &rtnetlink.LinkInfo{
+				Kind: network.LinkKindWireguard,
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("error creating wireguard link %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// Configure implements Backend.
+func (k *Kernel) Configure(name string, cfg *wgtypes.Config) error {
+	if err := k.client.ConfigureDevice(name, *cfg); err != nil {
+		return fmt.Errorf("error configuring wireguard device %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// Delete implements Backend.
+func (k *Kernel) Delete(name string) error {
+	links, err := k.conn.Link.List()
+	if err != nil {
+		return fmt.Errorf("error listing links: %w", err)
+	}
+
+	for _, link := range links {
+		if link.Attributes == nil || link.Attributes.Name != name {
+			continue
+		}
+
+		if err = k.conn.Link.Delete(link.Index); err != nil {
+			return fmt.Errorf("error deleting wireguard link %q: %w", name, err)
+		}
+
+		return nil
+	}
+
+	// already gone, nothing to do
+	return nil
+}
+
+// Device implements Backend.
+func (k *Kernel) Device(name string) (*wgtypes.Device, error) {
+	dev, err := k.client.Device(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting wireguard settings for %q: %w", name, err)
+	}
+
+	return dev, nil
+}
+
+// Close implements Backend.
+func (k *Kernel) Close() error {
+	return k.client.Close()
+}
@@ -0,0 +1,413 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// DefaultIdleTimeout is the default duration a peer may go without a handshake before
+// Lazy evicts it from the underlying device.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// NewLazy wraps inner so that peers are only materialized into the real device once
+// outbound traffic to them is observed (or explicitly requested via RequestPeer), and are
+// evicted again once idle for longer than idleTimeout.
+//
+// This borrows Tailscale's lazy-peer approach from wgengine: holding dozens or hundreds of
+// emulated peers per link is cheap in a shadow map, but materializing all of them into the
+// underlying device (kernel or userspace) is not, so Lazy only ever pushes down the peers
+// that are actually in use.
+//
+// Callers still diff the *full* desired network.WireguardSpec against what Device reports
+// to decide "did anything change?" — Lazy always reports the full shadow peer set from
+// Device, so that invariant (and the resulting "did the spec change" decision) is
+// unaffected by which peers happen to be materialized at the moment.
+func NewLazy(inner Backend, idleTimeout time.Duration) *Lazy {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	return &Lazy{
+		inner:       inner,
+		idleTimeout: idleTimeout,
+		links:       map[string]*lazyLink{},
+	}
+}
+
+// Lazy is a Backend decorator which only materializes "hot" peers into the wrapped
+// backend.
+type Lazy struct {
+	inner       Backend
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	links map[string]*lazyLink
+}
+
+// lazyLink tracks the full desired peer set and activity bookkeeping for a single link.
+type lazyLink struct {
+	// shadow holds the full desired configuration for every known peer, keyed by public key.
+	shadow map[wgtypes.Key]wgtypes.PeerConfig
+
+	// installed is the set of public keys currently materialized into the inner backend.
+	installed map[wgtypes.Key]struct{}
+
+	// lastActive records the last time a peer was observed to be active (handshake or
+	// explicit request), keyed by public key.
+	lastActive map[wgtypes.Key]time.Time
+}
+
+func newLazyLink() *lazyLink {
+	return &lazyLink{
+		shadow:     map[wgtypes.Key]wgtypes.PeerConfig{},
+		installed:  map[wgtypes.Key]struct{}{},
+		lastActive: map[wgtypes.Key]time.Time{},
+	}
+}
+
+// Create implements Backend.
+func (l *Lazy) Create(name string) error {
+	l.mu.Lock()
+	if _, ok := l.links[name]; !ok {
+		l.links[name] = newLazyLink()
+	}
+	l.mu.Unlock()
+
+	if err := l.inner.Create(name); err != nil {
+		return err
+	}
+
+	// if the inner backend exposes its outbound packets (currently only Userspace), watch
+	// them so a peer gets materialized the moment traffic destined to it shows up, instead
+	// of staying pending in the shadow set forever.
+	if obs, ok := l.inner.(observable); ok {
+		obs.SetObserver(name, func(packet []byte, dir filter.Direction) {
+			if dir != filter.Outbound {
+				return
+			}
+
+			l.activateOnTraffic(name, packet)
+		})
+	}
+
+	return nil
+}
+
+// Configure implements Backend.
+//
+// Non-peer fields (private key, listen port, firewall mark) are applied immediately.
+// Peers are recorded into the shadow set; a peer is only pushed into the inner backend if
+// it's already installed, so an update reaches it. A newly-added peer stays pending in the
+// shadow set, untouched by the inner backend, until traffic towards it is observed or it's
+// explicitly requested (see RequestPeer) — that's the whole point of this decorator.
+func (l *Lazy) Configure(name string, cfg *wgtypes.Config) error {
+	l.mu.Lock()
+	link, ok := l.links[name]
+	if !ok {
+		link = newLazyLink()
+		l.links[name] = link
+	}
+
+	immediate := &wgtypes.Config{
+		PrivateKey:   cfg.PrivateKey,
+		ListenPort:   cfg.ListenPort,
+		FirewallMark: cfg.FirewallMark,
+		ReplacePeers: cfg.ReplacePeers,
+	}
+
+	for _, peer := range cfg.Peers {
+		if peer.Remove {
+			delete(link.shadow, peer.PublicKey)
+			delete(link.lastActive, peer.PublicKey)
+
+			if _, wasInstalled := link.installed[peer.PublicKey]; wasInstalled {
+				delete(link.installed, peer.PublicKey)
+
+				immediate.Peers = append(immediate.Peers, peer)
+			}
+
+			continue
+		}
+
+		link.shadow[peer.PublicKey] = peer
+
+		if _, isInstalled := link.installed[peer.PublicKey]; isInstalled {
+			// already materialized, push the update (endpoint, keepalive, allowed ips,
+			// ...) through immediately
+			immediate.Peers = append(immediate.Peers, peer)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(immediate.Peers) == 0 && immediate.PrivateKey == nil && immediate.ListenPort == nil && immediate.FirewallMark == nil {
+		return nil
+	}
+
+	return l.inner.Configure(name, immediate)
+}
+
+// activateOnTraffic materializes the peer whose AllowedIPs cover packet's destination, if
+// any, and if it isn't already installed. It's the observed-traffic counterpart to
+// RequestPeer, feeding it from the outbound packet stream instead of an explicit caller.
+func (l *Lazy) activateOnTraffic(name string, packet []byte) {
+	dst, ok := packetDestination(packet)
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	link, ok := l.links[name]
+	if !ok {
+		l.mu.Unlock()
+
+		return
+	}
+
+	var (
+		target wgtypes.Key
+		found  bool
+	)
+
+	for pubKey, cfg := range link.shadow {
+		if _, installed := link.installed[pubKey]; installed {
+			continue
+		}
+
+		for _, ipNet := range cfg.AllowedIPs {
+			if ipNet.Contains(dst) {
+				target = pubKey
+				found = true
+
+				break
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+	l.mu.Unlock()
+
+	if !found {
+		return
+	}
+
+	// best-effort: traffic is just a trigger, not something the caller is waiting on, and
+	// the peer may have raced a removal since the check above
+	_ = l.RequestPeer(name, target)
+}
+
+// packetDestination extracts the destination address from an IPv4 or IPv6 packet.
+func packetDestination(packet []byte) (net.IP, bool) {
+	if len(packet) < 1 {
+		return nil, false
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, false
+		}
+
+		return net.IP(packet[16:20]), true
+	case 6:
+		if len(packet) < 40 {
+			return nil, false
+		}
+
+		return net.IP(packet[24:40]), true
+	default:
+		return nil, false
+	}
+}
+
+// RequestPeer synchronously materializes peer into the inner backend, if it's known and
+// not already installed. It's called from the send path (see activateOnTraffic) as soon as
+// outbound traffic towards one of the peer's AllowedIPs is observed, so the handshake can
+// proceed; it can also be called directly by anything else that knows a peer is about to be
+// needed.
+func (l *Lazy) RequestPeer(name string, publicKey wgtypes.Key) error {
+	l.mu.Lock()
+
+	link, ok := l.links[name]
+	if !ok {
+		l.mu.Unlock()
+
+		return fmt.Errorf("wireguard link %q not tracked", name)
+	}
+
+	peer, known := link.shadow[publicKey]
+	if !known {
+		l.mu.Unlock()
+
+		return fmt.Errorf("peer %s not found on link %q", publicKey, name)
+	}
+
+	link.lastActive[publicKey] = time.Now()
+
+	if _, installed := link.installed[publicKey]; installed {
+		l.mu.Unlock()
+
+		return nil
+	}
+
+	link.installed[publicKey] = struct{}{}
+	l.mu.Unlock()
+
+	peer.UpdateOnly = false
+
+	return l.inner.Configure(name, &wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
+}
+
+// Delete implements Backend.
+func (l *Lazy) Delete(name string) error {
+	l.mu.Lock()
+	delete(l.links, name)
+	l.mu.Unlock()
+
+	return l.inner.Delete(name)
+}
+
+// Device implements Backend.
+//
+// Device refreshes activity bookkeeping from the inner device's handshake times, evicts
+// peers idle for longer than idleTimeout, and returns a device reflecting the *full*
+// shadow peer set (merged with live endpoint/handshake/transfer stats for the peers that
+// happen to be installed), so callers diffing the full desired spec against it see config
+// churn only when the desired configuration actually changes.
+func (l *Lazy) Device(name string) (*wgtypes.Device, error) {
+	dev, err := l.inner.Device(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	link, ok := l.links[name]
+	if !ok {
+		return dev, nil
+	}
+
+	live := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+
+	for _, peer := range dev.Peers {
+		live[peer.PublicKey] = peer
+
+		if !peer.LastHandshakeTime.IsZero() {
+			link.lastActive[peer.PublicKey] = peer.LastHandshakeTime
+		}
+	}
+
+	cutoff := time.Now().Add(-l.idleTimeout)
+
+	for pubKey := range link.installed {
+		if lastActive, tracked := link.lastActive[pubKey]; tracked && lastActive.Before(cutoff) {
+			if err = l.inner.Configure(name, &wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{{PublicKey: pubKey, Remove: true}},
+			}); err != nil {
+				return nil, fmt.Errorf("error evicting idle peer %s from %q: %w", pubKey, name, err)
+			}
+
+			delete(link.installed, pubKey)
+			delete(live, pubKey)
+		}
+	}
+
+	merged := *dev
+	merged.Peers = make([]wgtypes.Peer, 0, len(link.shadow))
+
+	for pubKey, cfg := range link.shadow {
+		if peer, isLive := live[pubKey]; isLive {
+			merged.Peers = append(merged.Peers, peer)
+
+			continue
+		}
+
+		merged.Peers = append(merged.Peers, peerConfigToPeer(cfg))
+	}
+
+	return &merged, nil
+}
+
+// Close implements Backend.
+func (l *Lazy) Close() error {
+	return l.inner.Close()
+}
+
+// filterable is implemented by backends which support packet filtering on their links
+// (currently only Userspace). Lazy forwards to it so wrapping a Backend in Lazy doesn't
+// hide the capability from callers that only hold a Backend.
+type filterable interface {
+	SetFilter(name string, fn filter.Func) bool
+	InjectInbound(name string, packet []byte) bool
+	InjectOutbound(name string, packet []byte) bool
+}
+
+// observable is implemented by backends which can report their per-link outbound packet
+// stream (currently only Userspace). Lazy uses it to learn about traffic destined to peers
+// it hasn't materialized yet.
+type observable interface {
+	SetObserver(name string, fn filter.Observer) bool
+}
+
+// SetFilter forwards to the wrapped backend if it supports packet filtering, reporting
+// false otherwise.
+func (l *Lazy) SetFilter(name string, fn filter.Func) bool {
+	f, ok := l.inner.(filterable)
+	if !ok {
+		return false
+	}
+
+	return f.SetFilter(name, fn)
+}
+
+// InjectInbound forwards to the wrapped backend if it supports packet filtering, reporting
+// false otherwise.
+func (l *Lazy) InjectInbound(name string, packet []byte) bool {
+	f, ok := l.inner.(filterable)
+	if !ok {
+		return false
+	}
+
+	return f.InjectInbound(name, packet)
+}
+
+// InjectOutbound forwards to the wrapped backend if it supports packet filtering, reporting
+// false otherwise.
+func (l *Lazy) InjectOutbound(name string, packet []byte) bool {
+	f, ok := l.inner.(filterable)
+	if !ok {
+		return false
+	}
+
+	return f.InjectOutbound(name, packet)
+}
+
+func peerConfigToPeer(cfg wgtypes.PeerConfig) wgtypes.Peer {
+	peer := wgtypes.Peer{
+		PublicKey:  cfg.PublicKey,
+		Endpoint:   cfg.Endpoint,
+		AllowedIPs: cfg.AllowedIPs,
+	}
+
+	if cfg.PresharedKey != nil {
+		peer.PresharedKey = *cfg.PresharedKey
+	}
+
+	if cfg.PersistentKeepaliveInterval != nil {
+		peer.PersistentKeepaliveInterval = *cfg.PersistentKeepaliveInterval
+	}
+
+	return peer
+}
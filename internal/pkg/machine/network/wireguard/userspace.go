@@ -0,0 +1,468 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wireguard
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/siderolabs/talemu/internal/pkg/machine/network/filter"
+)
+
+// TunMode selects how a Userspace backend obtains the tun.Device it hands to the
+// WireGuard device: either a real (but still userspace, no kernel WG module involved)
+// TUN interface, or a pure-Go, no-TUN netstack so the emulated machine doesn't need any
+// host network device at all.
+type TunMode int
+
+const (
+	// TunModeTUN creates a real /dev/net/tun interface and hands it to the WireGuard
+	// device, same as upstream wireguard-go does.
+	TunModeTUN TunMode = iota
+
+	// TunModeNetstack creates an in-process gVisor netstack tun.Device, so the emulated
+	// machine needs neither CAP_NET_ADMIN nor a TUN device node.
+	TunModeNetstack
+)
+
+// NewUserspace creates a Backend that runs the WireGuard protocol entirely in-process,
+// using golang.zx2c4.com/wireguard/device, so it works without a kernel wireguard module,
+// and, with TunModeNetstack, without CAP_NET_ADMIN (TunModeTUN still creates a real TUN
+// interface).
+func NewUserspace(mode TunMode, logger *zap.Logger) Backend {
+	return &Userspace{
+		mode:    mode,
+		logger:  logger,
+		devices: map[string]*userspaceDevice{},
+	}
+}
+
+// Userspace is a Backend backed by an in-process WireGuard device.
+type Userspace struct {
+	mode   TunMode
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	devices map[string]*userspaceDevice
+}
+
+type userspaceDevice struct {
+	tunDev   tun.Device
+	filtered *filter.FilteredLink
+	dev      *device.Device
+}
+
+// Create implements Backend.
+func (u *Userspace) Create(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.devices[name]; ok {
+		return nil
+	}
+
+	tunDev, err := u.newTunDevice(name)
+	if err != nil {
+		return fmt.Errorf("error creating tun device for %q: %w", name, err)
+	}
+
+	// every link is wrapped in a FilteredLink, even if no filter is ever installed: the
+	// default filter is a no-op pass-through, so this costs nothing at steady state and
+	// means SetFilter/InjectInbound/InjectOutbound always work once the link exists.
+	filtered := filter.Wrap(tunDev)
+
+	dev := device.NewDevice(filtered, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: u.logger.Sugar().Debugf,
+		Errorf:   u.logger.Sugar().Errorf,
+	})
+
+	if err = dev.Up(); err != nil {
+		dev.Close()
+
+		return fmt.Errorf("error bringing up userspace wireguard device %q: %w", name, err)
+	}
+
+	u.devices[name] = &userspaceDevice{
+		tunDev:   tunDev,
+		filtered: filtered,
+		dev:      dev,
+	}
+
+	return nil
+}
+
+// SetFilter installs fn as the packet filter for the named link's underlying tun device.
+// It reports false if the link doesn't exist (e.g. it hasn't been Create'd yet).
+func (u *Userspace) SetFilter(name string, fn filter.Func) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return false
+	}
+
+	ud.filtered.SetFilter(fn)
+
+	return true
+}
+
+// SetObserver installs fn as the packet observer for the named link's underlying tun
+// device. It reports false if the link doesn't exist (e.g. it hasn't been Create'd yet).
+func (u *Userspace) SetObserver(name string, fn filter.Observer) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return false
+	}
+
+	ud.filtered.SetObserver(fn)
+
+	return true
+}
+
+// InjectInbound delivers packet to the named link as if it had arrived from the network.
+// It reports false if the link doesn't exist.
+func (u *Userspace) InjectInbound(name string, packet []byte) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return false
+	}
+
+	ud.filtered.InjectInbound(packet)
+
+	return true
+}
+
+// InjectOutbound delivers packet to the named link as if the emulated machine had sent it.
+// It reports false if the link doesn't exist.
+func (u *Userspace) InjectOutbound(name string, packet []byte) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return false
+	}
+
+	ud.filtered.InjectOutbound(packet)
+
+	return true
+}
+
+func (u *Userspace) newTunDevice(name string) (tun.Device, error) {
+	switch u.mode {
+	case TunModeNetstack:
+		// no addresses are pre-assigned here: the WireguardSpec diff logic only ever
+		// touches WireGuard-level config, so the IP stack is configured the same way as
+		// for a real kernel link, by the address/link controllers, against the
+		// host-visible side of the stack.
+		tunDev, _, _, err := netstack.CreateNetTUN(nil, nil, device.DefaultMTU)
+
+		return tunDev, err
+	default:
+		return tun.CreateTUN(name, device.DefaultMTU)
+	}
+}
+
+// Configure implements Backend.
+func (u *Userspace) Configure(name string, cfg *wgtypes.Config) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return fmt.Errorf("wireguard device %q not found", name)
+	}
+
+	return ud.dev.IpcSet(encodeIpcConfig(cfg))
+}
+
+// Delete implements Backend.
+func (u *Userspace) Delete(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return nil
+	}
+
+	ud.dev.Close()
+
+	delete(u.devices, name)
+
+	return nil
+}
+
+// Device implements Backend.
+func (u *Userspace) Device(name string) (*wgtypes.Device, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ud, ok := u.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("wireguard device %q not found", name)
+	}
+
+	ipcStr, err := ud.dev.IpcGet()
+	if err != nil {
+		return nil, fmt.Errorf("error reading userspace wireguard device %q state: %w", name, err)
+	}
+
+	return decodeIpcDevice(name, ipcStr)
+}
+
+// Close implements Backend.
+func (u *Userspace) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name, ud := range u.devices {
+		ud.dev.Close()
+
+		delete(u.devices, name)
+	}
+
+	return nil
+}
+
+// encodeIpcConfig translates a wgtypes.Config diff into the UAPI configuration protocol
+// understood by device.Device.IpcSet (see https://www.wireguard.com/xplatform/).
+func encodeIpcConfig(cfg *wgtypes.Config) string {
+	var b strings.Builder
+
+	if cfg.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", hexKey(*cfg.PrivateKey))
+	}
+
+	if cfg.ListenPort != nil {
+		fmt.Fprintf(&b, "listen_port=%d\n", *cfg.ListenPort)
+	}
+
+	if cfg.FirewallMark != nil {
+		fmt.Fprintf(&b, "fwmark=%d\n", *cfg.FirewallMark)
+	}
+
+	if cfg.ReplacePeers {
+		b.WriteString("replace_peers=true\n")
+	}
+
+	for _, peer := range cfg.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hexKey(peer.PublicKey))
+
+		if peer.Remove {
+			b.WriteString("remove=true\n")
+
+			continue
+		}
+
+		if peer.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+
+		if peer.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hexKey(*peer.PresharedKey))
+		}
+
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint.String())
+		}
+
+		if peer.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(peer.PersistentKeepaliveInterval.Seconds()))
+		}
+
+		if peer.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+
+		for _, ip := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip.String())
+		}
+	}
+
+	return b.String()
+}
+
+// decodeIpcDevice parses the UAPI "get" response into a wgtypes.Device, mirroring what
+// wgctrl.Client.Device returns for a kernel device, so the reconcile loop in
+// LinkSpecController can treat both backends identically. This includes the endpoint,
+// which the reconcile loop's WireguardSpec diff relies on to decide whether a peer actually
+// needs reconfiguring, and the last-handshake-time, which Lazy uses to evict idle peers.
+func decodeIpcDevice(name, ipcStr string) (*wgtypes.Device, error) {
+	dev := &wgtypes.Device{Name: name, Type: wgtypes.LinuxKernel}
+
+	var (
+		peer         *wgtypes.Peer
+		handshakeSec int64
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(ipcStr))
+
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "private_key":
+			k, err := parseHexKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing private key: %w", err)
+			}
+
+			dev.PrivateKey = k
+			dev.PublicKey = k.PublicKey()
+		case "listen_port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing listen port: %w", err)
+			}
+
+			dev.ListenPort = port
+		case "fwmark":
+			mark, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing fwmark: %w", err)
+			}
+
+			dev.FirewallMark = mark
+		case "public_key":
+			k, err := parseHexKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer public key: %w", err)
+			}
+
+			dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: k})
+			peer = &dev.Peers[len(dev.Peers)-1]
+		case "preshared_key":
+			if peer == nil {
+				continue
+			}
+
+			k, err := parseHexKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer preshared key: %w", err)
+			}
+
+			peer.PresharedKey = k
+		case "persistent_keepalive_interval":
+			if peer == nil {
+				continue
+			}
+
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing persistent keepalive interval: %w", err)
+			}
+
+			peer.PersistentKeepaliveInterval = time.Duration(seconds) * time.Second
+		case "allowed_ip":
+			if peer == nil {
+				continue
+			}
+
+			_, ipNet, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer allowed ip: %w", err)
+			}
+
+			peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+		case "endpoint":
+			if peer == nil {
+				continue
+			}
+
+			addr, err := net.ResolveUDPAddr("udp", value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer endpoint: %w", err)
+			}
+
+			peer.Endpoint = addr
+		case "last_handshake_time_sec":
+			if peer == nil {
+				continue
+			}
+
+			sec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer last handshake time: %w", err)
+			}
+
+			handshakeSec = sec
+		case "last_handshake_time_nsec":
+			if peer == nil {
+				continue
+			}
+
+			nsec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer last handshake time: %w", err)
+			}
+
+			if handshakeSec != 0 || nsec != 0 {
+				peer.LastHandshakeTime = time.Unix(handshakeSec, nsec)
+			}
+		case "rx_bytes":
+			if peer == nil {
+				continue
+			}
+
+			rx, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer rx bytes: %w", err)
+			}
+
+			peer.ReceiveBytes = rx
+		case "tx_bytes":
+			if peer == nil {
+				continue
+			}
+
+			tx, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing peer tx bytes: %w", err)
+			}
+
+			peer.TransmitBytes = tx
+		}
+	}
+
+	return dev, scanner.Err()
+}
+
+func hexKey(key wgtypes.Key) string {
+	return fmt.Sprintf("%x", key[:])
+}
+
+// parseHexKey is the inverse of hexKey: UAPI reports keys hex-encoded, not base64.
+func parseHexKey(s string) (wgtypes.Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	return wgtypes.NewKey(b)
+}